@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// BalancePolicy selects one record out of a HostTable's current record
+// list. Implementations that keep derived state (round-robin counters, a
+// hash ring) rebuild it via Rebuild whenever the table's records change.
+// Rebuild is always called with HostDB.mu held for writing, so it never
+// overlaps a Pick; Pick is called with HostDB.mu held only for reading, so
+// several Picks can run at once and a Pick that mutates state must guard it
+// itself.
+type BalancePolicy interface {
+	// Rebuild recomputes any state derived from the current record list.
+	Rebuild(recs []*HostRecord)
+
+	// Pick returns a record for sessionKey, or nil if there are none.
+	// sessionKey may be empty, in which case policies that support
+	// affinity should fall back to their non-affine behaviour.
+	Pick(sessionKey string) *HostRecord
+}
+
+// newDefaultBalancePolicy is the factory used for every new HostTable.
+// Override it (e.g. from config) before any hosts are registered.
+var newDefaultBalancePolicy = func() BalancePolicy { return newConsistentHashPolicy() }
+
+// weightedRandomPolicy picks a record at random, weighted by HostRecord.Weight.
+type weightedRandomPolicy struct {
+	recs   []*HostRecord
+	weight int
+}
+
+func newWeightedRandomPolicy() *weightedRandomPolicy {
+	return &weightedRandomPolicy{}
+}
+
+func (p *weightedRandomPolicy) Rebuild(recs []*HostRecord) {
+	p.recs = recs
+	p.weight = 0
+	for _, rec := range recs {
+		p.weight += rec.Weight
+	}
+}
+
+func (p *weightedRandomPolicy) Pick(sessionKey string) *HostRecord {
+	recs, weight := availableRecs(p.recs)
+	if len(recs) == 0 {
+		return nil
+	}
+	if weight <= 0 {
+		return recs[rand.Intn(len(recs))]
+	}
+
+	w := rand.Intn(weight)
+	for _, rec := range recs {
+		if rec.Weight > w {
+			return rec
+		}
+		w -= rec.Weight
+	}
+	return recs[len(recs)-1]
+}
+
+// availableRecs filters out records the health checker or circuit breaker
+// has marked unavailable, along with their combined weight.
+func availableRecs(recs []*HostRecord) ([]*HostRecord, int) {
+	out := make([]*HostRecord, 0, len(recs))
+	weight := 0
+	for _, rec := range recs {
+		if !rec.available() {
+			continue
+		}
+		out = append(out, rec)
+		weight += rec.Weight
+	}
+	return out, weight
+}
+
+// smoothWeightedRoundRobinPolicy implements Nginx's smooth weighted
+// round-robin: every Pick, each entry's current weight grows by its
+// effective weight, the entry with the highest current weight is chosen,
+// and the total weight is subtracted back off the winner. This spreads
+// picks evenly instead of bursting toward the heaviest host.
+type smoothWeightedRoundRobinPolicy struct {
+	mu      sync.Mutex // guards currentWeight across concurrent Picks
+	entries []*swrrEntry
+	weight  int
+}
+
+type swrrEntry struct {
+	rec             *HostRecord
+	effectiveWeight int
+	currentWeight   int
+}
+
+func newSmoothWeightedRoundRobinPolicy() *smoothWeightedRoundRobinPolicy {
+	return &smoothWeightedRoundRobinPolicy{}
+}
+
+func (p *smoothWeightedRoundRobinPolicy) Rebuild(recs []*HostRecord) {
+	entries := make([]*swrrEntry, 0, len(recs))
+	weight := 0
+	for _, rec := range recs {
+		entries = append(entries, &swrrEntry{rec: rec, effectiveWeight: rec.Weight})
+		weight += rec.Weight
+	}
+	p.entries = entries
+	p.weight = weight
+}
+
+func (p *smoothWeightedRoundRobinPolicy) Pick(sessionKey string) *HostRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *swrrEntry
+	for _, e := range p.entries {
+		if !e.rec.available() {
+			continue
+		}
+		e.currentWeight += e.effectiveWeight
+		if best == nil || e.currentWeight > best.currentWeight {
+			best = e
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.currentWeight -= p.weight
+	return best.rec
+}
+
+const hashRingVnodesPerWeight = 160
+
+// consistentHashPolicy hashes sessionKey onto a ring of virtual nodes, so
+// the same session keeps landing on the same backend across reconnects,
+// and adding/removing a host only remaps the vnodes that moved. Falls back
+// to weighted random when sessionKey is empty.
+type consistentHashPolicy struct {
+	ring   []vnode
+	recs   []*HostRecord
+	weight int
+}
+
+type vnode struct {
+	hash uint32
+	rec  *HostRecord
+}
+
+func newConsistentHashPolicy() *consistentHashPolicy {
+	return &consistentHashPolicy{}
+}
+
+func (p *consistentHashPolicy) Rebuild(recs []*HostRecord) {
+	p.recs = recs
+	p.weight = 0
+	for _, rec := range recs {
+		p.weight += rec.Weight
+	}
+
+	ring := make([]vnode, 0, len(recs)*hashRingVnodesPerWeight)
+	for _, rec := range recs {
+		weight := rec.Weight
+		if weight <= 0 {
+			weight = defaultWeight
+		}
+		// vnode count scales with weight relative to the default, so a
+		// heavier host claims proportionally more of the ring.
+		vnodes := hashRingVnodesPerWeight * weight / defaultWeight
+		if vnodes <= 0 {
+			vnodes = 1
+		}
+		for i := 0; i < vnodes; i++ {
+			ring = append(ring, vnode{hash: hashKey(rec.key, i), rec: rec})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	p.ring = ring
+}
+
+func hashKey(key string, n int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	h.Write([]byte{byte(n), byte(n >> 8)})
+	return h.Sum32()
+}
+
+func (p *consistentHashPolicy) Pick(sessionKey string) *HostRecord {
+	if len(p.recs) == 0 {
+		return nil
+	}
+	if sessionKey == "" {
+		return (&weightedRandomPolicy{recs: p.recs, weight: p.weight}).Pick("")
+	}
+	if len(p.ring) == 0 {
+		return nil
+	}
+
+	h := hashKey(sessionKey, 0)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+
+	// Walk forward from the hash's ring position, wrapping around, until
+	// an available host is found; only the failed host's own vnodes are
+	// skipped, so the remap stays local instead of reshuffling sessions.
+	for i := 0; i < len(p.ring); i++ {
+		rec := p.ring[(start+i)%len(p.ring)].rec
+		if rec.available() {
+			return rec
+		}
+	}
+	return nil
+}
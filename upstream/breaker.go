@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/xjdrew/glog"
+)
+
+// BreakerEventHook is notified whenever a record's breaker trips or
+// resets, so operators can log or alert without depending on Prometheus.
+type BreakerEventHook func(rec *HostRecord, open bool)
+
+// CircuitBreakerOptions configures NewCircuitBreaker; a zero value falls
+// back to sane defaults.
+type CircuitBreakerOptions struct {
+	FailureThreshold int
+	Cooldown         time.Duration
+	Hook             BreakerEventHook
+}
+
+func (o *CircuitBreakerOptions) withDefaults() CircuitBreakerOptions {
+	out := *o
+	if out.FailureThreshold <= 0 {
+		out.FailureThreshold = 5
+	}
+	if out.Cooldown <= 0 {
+		out.Cooldown = 30 * time.Second
+	}
+	return out
+}
+
+// CircuitBreakerOptionsFromViper reads `circuit_breaker.*` out of the
+// global config: failure_threshold, cooldown (both optional).
+func CircuitBreakerOptionsFromViper() CircuitBreakerOptions {
+	return CircuitBreakerOptions{
+		FailureThreshold: viper.GetInt("circuit_breaker.failure_threshold"),
+		Cooldown:         viper.GetDuration("circuit_breaker.cooldown"),
+	}
+}
+
+// CircuitBreaker trips a HostRecord out of rotation after FailureThreshold
+// consecutive dial/handshake failures, short-circuiting it for Cooldown;
+// BalancePolicy.Pick checks HostRecord.available, which folds in the
+// breaker state alongside the health checker's.
+type CircuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu       sync.Mutex
+	failures map[string]int // rec.key -> consecutive failures
+}
+
+// NewCircuitBreaker builds a breaker; it has no background goroutine, it
+// only reacts to RecordSuccess/RecordFailure calls from NewConn.
+func NewCircuitBreaker(opts CircuitBreakerOptions) *CircuitBreaker {
+	return &CircuitBreaker{
+		opts:     opts.withDefaults(),
+		failures: map[string]int{},
+	}
+}
+
+// defaultBreakerHolder boxes the active *CircuitBreaker so SetCircuitBreaker
+// can publish a new one atomically; NewConn reads it from arbitrary
+// goroutines and would otherwise race with a concurrent Set.
+var defaultBreakerHolder atomic.Value // *CircuitBreaker
+
+func init() {
+	defaultBreakerHolder.Store(NewCircuitBreaker(CircuitBreakerOptions{}))
+}
+
+// SetCircuitBreaker replaces the breaker NewConn reports dial/handshake
+// outcomes to.
+func SetCircuitBreaker(b *CircuitBreaker) {
+	defaultBreakerHolder.Store(b)
+}
+
+// currentBreaker returns the breaker NewConn should report outcomes to.
+func currentBreaker() *CircuitBreaker {
+	return defaultBreakerHolder.Load().(*CircuitBreaker)
+}
+
+// RecordSuccess clears rec's consecutive-failure count and, if its breaker
+// was open, closes it immediately instead of waiting out the cooldown. The
+// hook only fires when the breaker was actually open, so a single transient
+// failure followed by a success doesn't raise a spurious "circuit closed"
+// alert.
+func (b *CircuitBreaker) RecordSuccess(rec *HostRecord) {
+	b.mu.Lock()
+	delete(b.failures, rec.key)
+	b.mu.Unlock()
+
+	if atomic.SwapInt64(&rec.circuitOpenUntil, 0) != 0 {
+		if b.opts.Hook != nil {
+			b.opts.Hook(rec, false)
+		}
+	}
+}
+
+// RecordFailure bumps rec's consecutive-failure count, tripping the
+// breaker once it reaches FailureThreshold.
+func (b *CircuitBreaker) RecordFailure(rec *HostRecord) {
+	b.mu.Lock()
+	b.failures[rec.key]++
+	n := b.failures[rec.key]
+	b.mu.Unlock()
+
+	if n < b.opts.FailureThreshold {
+		return
+	}
+
+	atomic.StoreInt64(&rec.circuitOpenUntil, time.Now().Add(b.opts.Cooldown).UnixNano())
+	glog.Errorf("upstream: circuit open for host %v after %d consecutive failures, cooldown %v", rec.addr, n, b.opts.Cooldown)
+	glog.Flush()
+	if b.opts.Hook != nil {
+		b.opts.Hook(rec, true)
+	}
+}
@@ -5,14 +5,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/coreos/etcd/clientv3"
+	"github.com/Masterminds/semver/v3"
+	"github.com/ejoy/goscon/upstream/discovery"
+	_ "github.com/ejoy/goscon/upstream/discovery/consul"
+	_ "github.com/ejoy/goscon/upstream/discovery/etcdv2"
+	_ "github.com/ejoy/goscon/upstream/discovery/etcdv3"
+	_ "github.com/ejoy/goscon/upstream/discovery/zookeeper"
 	"github.com/spf13/viper"
 	"github.com/xjdrew/glog"
 )
@@ -28,60 +33,95 @@ type HostRecord struct {
 	Weight  int    `json:"weight"`
 	Version string `json:"version"`
 
-	numVer uint64
-	strVer string
-	addr   string
-	key    string
+	// Constraint optionally pins this table to a semver range, e.g.
+	// ">=1.2.0,<2.0.0", "~1.3" or "^1.0". When set, HostDB.query prefers
+	// the highest-numVer table whose Constraint is satisfied by the
+	// client version, instead of falling back to the nearest lower one.
+	Constraint string `json:"constraint"`
+
+	numVer     uint64
+	strVer     string
+	addr       string
+	key        string
+	constraint *semver.Constraints
+
+	// unhealthy and circuitOpenUntil are written by the health checker
+	// and circuit breaker in health.go/breaker.go; both are read on every
+	// BalancePolicy.Pick, so they're plain atomics rather than behind
+	// HostDB.mu.
+	unhealthy        int32 // atomic; 0 = healthy (zero value), 1 = unhealthy
+	circuitOpenUntil int64 // atomic unix nanoseconds; 0 = closed
+}
+
+// Addr returns the backend's dial address, as chosen by QueryHost.
+func (r *HostRecord) Addr() string {
+	return r.addr
+}
+
+// available reports whether a record should be considered by
+// BalancePolicy.Pick: not flagged unhealthy, and not inside an open
+// circuit breaker cooldown window.
+func (r *HostRecord) available() bool {
+	if atomic.LoadInt32(&r.unhealthy) != 0 {
+		return false
+	}
+	if until := atomic.LoadInt64(&r.circuitOpenUntil); until != 0 && time.Now().UnixNano() < until {
+		return false
+	}
+	return true
 }
 
 type HostTable struct {
-	weight  int
-	numVer  uint64
-	recList []*HostRecord
+	weight     int
+	numVer     uint64
+	constraint *semver.Constraints
+	recList    []*HostRecord
+	policy     BalancePolicy
 }
 
-func (p *HostTable) put(rec *HostRecord) {
+// put adds rec, or updates its addr if already present, and reports
+// whether rec was newly added.
+func (p *HostTable) put(rec *HostRecord) (added bool) {
+	if rec.constraint != nil {
+		p.constraint = rec.constraint
+	}
+
 	for _, exist := range p.recList {
 		if exist.key == rec.key {
 			exist.addr = rec.addr
-			return
+			p.policy.Rebuild(p.recList)
+			return false
 		}
 	}
 
 	p.weight += rec.Weight
 	p.recList = append(p.recList, rec)
+	p.policy.Rebuild(p.recList)
+	return true
 }
 
-func (p *HostTable) delete(key string) bool {
+// delete removes the record keyed by key, returning it, or nil if it
+// wasn't present.
+func (p *HostTable) delete(key string) *HostRecord {
 	for i, rec := range p.recList {
 		if rec.key == key {
 			p.weight -= rec.Weight
 			p.recList = append(p.recList[:i], p.recList[i+1:]...)
-			return true
+			p.policy.Rebuild(p.recList)
+			return rec
 		}
 	}
-	return false
+	return nil
 }
 
-func (p *HostTable) query() string {
-	// 主机全部离线
+// query returns a record for sessionKey, which may be empty; see
+// BalancePolicy for how that affects session affinity.
+func (p *HostTable) query(sessionKey string) *HostRecord {
 	if len(p.recList) == 0 {
-		return ""
-	}
-
-	// 停用按权重分配
-	// w := rand.Intn(p.weight)
-	// for _, rec := range p.records {
-	// 	if rec.Weight >= w {
-	// 		return rec.addr
-	// 	}
-	// 	w -= rec.Weight
-	// }
-	// return ""
-
-	// 随机分配1个
-	i := rand.Intn(len(p.recList))
-	return p.recList[i].addr
+		return nil
+	}
+
+	return p.policy.Pick(sessionKey)
 }
 
 type HostDB struct {
@@ -90,50 +130,95 @@ type HostDB struct {
 }
 
 func (p *HostDB) put(rec *HostRecord) {
-	defer p.mu.Unlock()
 	p.mu.Lock()
-
 	tb := p.tables[rec.strVer]
 	if tb == nil {
-		tb = &HostTable{numVer: rec.numVer}
+		tb = &HostTable{numVer: rec.numVer, policy: newDefaultBalancePolicy()}
 		p.tables[rec.strVer] = tb
 	}
+	added := tb.put(rec)
+	p.mu.Unlock()
 
-	tb.put(rec)
+	if added {
+		metricHosts.WithLabelValues(rec.strVer).Inc()
+		if hook := currentEventHook(); hook != nil {
+			hook.OnHostUp(rec)
+		}
+	}
 }
 
 func (p *HostDB) delete(key string) {
-	defer p.mu.Unlock()
 	p.mu.Lock()
-
-	for _, tb := range p.tables {
-		if tb.delete(key) {
+	var removed *HostRecord
+	var strVer string
+	for ver, tb := range p.tables {
+		if rec := tb.delete(key); rec != nil {
+			removed = rec
+			strVer = ver
 			break
 		}
 	}
+	p.mu.Unlock()
+
+	if removed != nil {
+		metricHosts.WithLabelValues(strVer).Dec()
+		if hook := currentEventHook(); hook != nil {
+			hook.OnHostDown(removed)
+		}
+	}
 }
 
-func (p *HostDB) query(strVer string) string {
-	defer p.mu.RUnlock()
+func (p *HostDB) query(strVer, sessionKey string) *HostRecord {
+	rec, result := p.pick(strVer, sessionKey)
+	observeQuery(strVer, result)
+	return rec
+}
+
+// pick holds p.mu only long enough to select a record, returning it
+// alongside the result label to report; observeQuery fires the
+// Prometheus metric and EventHook after the lock is released, mirroring
+// put()/delete(), since a reentrant EventHook.OnQuery that calls back
+// into put()/delete() would deadlock on the non-reentrant RWMutex
+// otherwise.
+func (p *HostDB) pick(strVer, sessionKey string) (*HostRecord, string) {
 	p.mu.RLock()
+	defer p.mu.RUnlock()
 
 	if len(p.tables) == 0 {
-		return ""
+		return nil, "miss"
 	}
 
 	// 版本精确匹配
 	if tb := p.tables[strVer]; tb != nil {
-		return tb.query()
+		rec := tb.query(sessionKey)
+		return rec, resultFor(rec, "hit")
 	}
 
-	// 查找最临近的最小版本主机表
 	numVer, err := toNumVer(strVer)
 	if err != nil {
 		glog.Errorf("invalid version from client: %v", strVer)
 		glog.Flush()
-		return ""
+		return nil, "miss"
+	}
+
+	// 优先匹配声明了 constraint 的主机表, 取满足条件中版本最高的一个
+	if sver, err := semver.NewVersion(strVer); err == nil {
+		var best *HostTable
+		for _, tb := range p.tables {
+			if tb.constraint == nil || !tb.constraint.Check(sver) {
+				continue
+			}
+			if best == nil || tb.numVer > best.numVer {
+				best = tb
+			}
+		}
+		if best != nil {
+			rec := best.query(sessionKey)
+			return rec, resultFor(rec, "fallback")
+		}
 	}
 
+	// 查找最临近的最小版本主机表
 	tables := []*HostTable{}
 	for _, tb := range p.tables {
 		tables = append(tables, tb)
@@ -147,16 +232,54 @@ func (p *HostDB) query(strVer string) string {
 
 	for _, tb := range tables {
 		if numVer > tb.numVer {
-			return tb.query()
+			rec := tb.query(sessionKey)
+			return rec, resultFor(rec, "fallback")
 		}
 	}
 
 	// 前端上传的版本号 比最小版本服还小
-	return ""
+	return nil, "miss"
+}
+
+// resultFor downgrades result to "miss" when rec is nil, e.g. a table
+// matched but every record in it is unhealthy or breaker-tripped.
+func resultFor(rec *HostRecord, result string) string {
+	if rec == nil {
+		return "miss"
+	}
+	return result
+}
+
+func observeQuery(version, result string) {
+	metricQueryTotal.WithLabelValues(version, result).Inc()
+	if hook := currentEventHook(); hook != nil {
+		hook.OnQuery(version, result)
+	}
+}
+
+// allRecords snapshots every record currently known to the db, across all
+// version tables; used by the health checker to probe the full fleet.
+func (p *HostDB) allRecords() []*HostRecord {
+	defer p.mu.RUnlock()
+	p.mu.RLock()
+
+	var recs []*HostRecord
+	for _, tb := range p.tables {
+		recs = append(recs, tb.recList...)
+	}
+	return recs
 }
 
+// toNumVer packs a dotted version string into a comparable uint64, 16 bits
+// per component. Pre-release/build metadata (e.g. "1.2.3-rc1", "1.2.3+build5")
+// is stripped before parsing so such versions still bucket into a HostTable.
 func toNumVer(strVer string) (uint64, error) {
-	strs := strings.Split(strVer, ".")
+	base := strVer
+	if i := strings.IndexAny(base, "-+"); i >= 0 {
+		base = base[:i]
+	}
+
+	strs := strings.Split(base, ".")
 	if len(strs) != 3 {
 		return 0, errors.New("invalid version string")
 	}
@@ -191,122 +314,152 @@ func parseHost(key, value []byte) (*HostRecord, error) {
 	rec.numVer = numVer
 	rec.addr = fmt.Sprintf("%v:%v", rec.Host, rec.Port)
 	rec.key = string(key)
-	return rec, nil
-}
 
-func openEtcd(etcdHost string) (*clientv3.Client, error) {
-	return clientv3.New(clientv3.Config{
-		Endpoints:   []string{etcdHost},
-		DialTimeout: 5 * time.Second,
-	})
+	if rec.Constraint != "" {
+		constraint, err := semver.NewConstraint(rec.Constraint)
+		if err != nil {
+			return nil, fmt.Errorf("host constraint is invalid: %w", err)
+		}
+		rec.constraint = constraint
+	}
+
+	return rec, nil
 }
 
-func getExistKeyValues(cli *clientv3.Client, etcdPrefix string) bool {
-	resp, err := cli.Get(context.Background(), etcdPrefix, clientv3.WithPrefix())
+// resync lists the current snapshot under prefix and diffs it against
+// known (the keys this loop last fed into _DB for prefix), feeding new or
+// changed entries into _DB.put and feeding anything that vanished into
+// _DB.delete, so a watch that dropped out from under us can't leave a
+// deregistered host routable forever. known is updated in place to match
+// the fresh snapshot.
+func resync(drv discovery.Discovery, prefix string, known map[string][]byte) bool {
+	kvs, err := drv.List(prefix)
 	if err != nil {
-		glog.Errorf("GET exist key values error: %v", err)
+		glog.Errorf("discovery: list %v failed: %v", prefix, err)
 		glog.Flush()
 		return false
 	}
 
-	for _, kv := range resp.Kvs {
-		rec, err := parseHost(kv.Key, kv.Value)
+	fresh := make(map[string][]byte, len(kvs))
+	for _, kv := range kvs {
+		fresh[kv.Key] = kv.Value
+		if old, ok := known[kv.Key]; ok && string(old) == string(kv.Value) {
+			continue
+		}
+
+		rec, err := parseHost([]byte(kv.Key), kv.Value)
 		if err != nil {
-			glog.Errorf("GET decode error: %v, key: %v, value: %v", err, string(kv.Key), string(kv.Value))
+			glog.Errorf("discovery: decode error: %v, key: %v, value: %v", err, kv.Key, string(kv.Value))
 			glog.Flush()
-			return false
+			continue
 		}
 
-		glog.Infof("GET host key: %v, hostport: %v:%v", string(kv.Key), rec.Host, rec.Port)
+		glog.Infof("discovery: host key: %v, hostport: %v:%v", kv.Key, rec.Host, rec.Port)
 		glog.Flush()
 		_DB.put(rec)
 	}
 
+	for key := range known {
+		if _, ok := fresh[key]; !ok {
+			glog.Infof("discovery: resync DEL host %v", key)
+			glog.Flush()
+			_DB.delete(key)
+		}
+	}
+
+	for key := range known {
+		delete(known, key)
+	}
+	for key, value := range fresh {
+		known[key] = value
+	}
+
 	return true
 }
 
-func watchEtcd(etcdHost, etcdPrefix string) {
-	var cli *clientv3.Client
-	var err error
-
+// watchDiscovery resyncs the prefix into _DB (diffing against known, which
+// persists across repeated calls so a reconnect's resync still emits
+// deletes for anything that vanished while the previous watch was down),
+// then streams Put/Delete events from drv until the watch channel closes,
+// at which point it returns so the caller can retry.
+func watchDiscovery(drv discovery.Discovery, prefix string, known map[string][]byte) {
 	for {
-		glog.Infof("begin connect etcd host %v", etcdHost)
-		glog.Flush()
-
-		cli, err = openEtcd(etcdHost)
-		if err != nil {
-			glog.Errorf("connect etcd host %v error: %v", etcdHost, err)
-			glog.Flush()
+		if !resync(drv, prefix, known) {
 			time.Sleep(time.Second)
 			continue
-
-		} else {
-			glog.Infof("connect etcd host %v succeed", etcdHost)
-			glog.Flush()
-
-			if !getExistKeyValues(cli, etcdPrefix) {
-				cli.Close()
-				continue
-			}
-
-			break
 		}
+		break
 	}
 
-	wch := cli.Watch(context.Background(), etcdPrefix, clientv3.WithPrefix())
-	for msg := range wch {
-		for _, ev := range msg.Events {
-			switch ev.Type {
-			case clientv3.EventTypePut:
-				rec, err := parseHost(ev.Kv.Key, ev.Kv.Value)
-				if err != nil {
-					glog.Errorf("put event decode error: %v, key: %v, value: %v", err, string(ev.Kv.Key), string(ev.Kv.Value))
-					glog.Flush()
-					continue
-				}
-				glog.Infof("PUT host key: %v, hostport: %v:%v", string(ev.Kv.Key), rec.Host, rec.Port)
-				glog.Flush()
-				_DB.put(rec)
-
-			case clientv3.EventTypeDelete:
-				glog.Infof("DEL host %v", string(ev.Kv.Key))
-				glog.Flush()
-				_DB.delete(string(ev.Kv.Key))
+	ch, err := drv.Watch(context.Background(), prefix)
+	if err != nil {
+		glog.Errorf("discovery: watch %v failed: %v", prefix, err)
+		glog.Flush()
+		return
+	}
 
-			default:
-				glog.Errorf("unexpected etcd event: %v", ev.Type)
+	for ev := range ch {
+		switch ev.Type {
+		case discovery.EventPut:
+			metricEtcdEventsTotal.WithLabelValues("put").Inc()
+			rec, err := parseHost([]byte(ev.Key), ev.Value)
+			if err != nil {
+				glog.Errorf("discovery: put event decode error: %v, key: %v, value: %v", err, ev.Key, string(ev.Value))
 				glog.Flush()
+				continue
 			}
+			glog.Infof("discovery: PUT host key: %v, hostport: %v:%v", ev.Key, rec.Host, rec.Port)
+			glog.Flush()
+			known[ev.Key] = ev.Value
+			_DB.put(rec)
+
+		case discovery.EventDelete:
+			metricEtcdEventsTotal.WithLabelValues("delete").Inc()
+			glog.Infof("discovery: DEL host %v", ev.Key)
+			glog.Flush()
+			delete(known, ev.Key)
+			_DB.delete(ev.Key)
 		}
 	}
 
-	cli.Close()
-	glog.Errorf("disconnect from etcd host: %v", etcdHost)
+	glog.Errorf("discovery: watch channel for %v closed, will resync", prefix)
 	glog.Flush()
 }
 
 // 模块api
 func WatchHost() {
-	etcdHost := viper.GetString("etcd_host")
-	if etcdHost == "" {
-		glog.Exit("etcd_host not found in config")
+	backend := viper.GetString("discovery.backend")
+	if backend == "" {
+		backend = "etcd"
+	}
+
+	prefix := viper.GetString("discovery.prefix")
+	if prefix == "" {
+		glog.Exit("discovery.prefix not found in config")
 	}
 
-	etcdPrefix := viper.GetString("etcd_prefix")
-	if etcdPrefix == "" {
-		glog.Exit("etcd_prefix not found in config")
+	v := viper.Sub("discovery." + backend)
+
+	drv, err := discovery.New(backend, v)
+	if err != nil {
+		glog.Exitf("discovery: failed to init backend %q: %v", backend, err)
 	}
 
 	go func() {
+		known := map[string][]byte{}
 		for {
-			watchEtcd(etcdHost, etcdPrefix)
+			watchDiscovery(drv, prefix, known)
 		}
 	}()
 
-	glog.Infof("waiting for the first upstream host be online: %v", etcdHost)
+	glog.Infof("waiting for the first upstream host be online: backend=%v, prefix=%v", backend, prefix)
 	glog.Flush()
 }
 
-func QueryHost(strVer string) string {
-	return _DB.query(strVer)
+// QueryHost picks a backend record for strVer, skipping records the health
+// checker or circuit breaker has marked unavailable, or nil if none
+// qualify. sessionKey, when non-empty, is fed to the table's BalancePolicy
+// so the same key keeps landing on the same backend across reconnects.
+func QueryHost(strVer, sessionKey string) *HostRecord {
+	return _DB.query(strVer, sessionKey)
 }
@@ -0,0 +1,126 @@
+// Package consul is a discovery.Discovery driver backed by Consul's KV API.
+package consul
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ejoy/goscon/upstream/discovery"
+	"github.com/ejoy/goscon/upstream/internal/backoff"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	discovery.Register("consul", New)
+}
+
+type driver struct {
+	kv *consulapi.KV
+}
+
+// New builds a Consul driver from config scoped at `discovery.consul`:
+//
+//	address  host:port of the agent, default "127.0.0.1:8500"
+//	scheme   "http" or "https", default "http"
+//	token    ACL token, optional
+func New(v *viper.Viper) (discovery.Discovery, error) {
+	cfg := consulapi.DefaultConfig()
+	if address := v.GetString("address"); address != "" {
+		cfg.Address = address
+	}
+	if scheme := v.GetString("scheme"); scheme != "" {
+		cfg.Scheme = scheme
+	}
+	if token := v.GetString("token"); token != "" {
+		cfg.Token = token
+	}
+
+	cli, err := consulapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("consul: %w", err)
+	}
+
+	return &driver{kv: cli.KV()}, nil
+}
+
+func (d *driver) List(prefix string) ([]discovery.KV, error) {
+	pairs, _, err := d.kv.List(prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make([]discovery.KV, 0, len(pairs))
+	for _, pair := range pairs {
+		kvs = append(kvs, discovery.KV{Key: pair.Key, Value: pair.Value})
+	}
+	return kvs, nil
+}
+
+// Watch polls Consul's blocking queries, diffing each fresh snapshot
+// against the previous one to emit Put for new/changed keys and Delete
+// for keys that disappeared. A failed poll backs off and retries instead
+// of giving up, so a connectivity blip can't permanently stop deletes from
+// reaching the caller.
+func (d *driver) Watch(ctx context.Context, prefix string) (<-chan discovery.Event, error) {
+	out := make(chan discovery.Event)
+
+	go func() {
+		defer close(out)
+
+		var waitIndex uint64
+		seen := map[string][]byte{}
+		attempt := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			opts := (&consulapi.QueryOptions{WaitIndex: waitIndex}).WithContext(ctx)
+			pairs, meta, err := d.kv.List(prefix, opts)
+			if err != nil {
+				select {
+				case <-time.After(backoff.Next(attempt)):
+				case <-ctx.Done():
+					return
+				}
+				attempt++
+				waitIndex = 0
+				continue
+			}
+			attempt = 0
+			waitIndex = meta.LastIndex
+
+			fresh := map[string][]byte{}
+			for _, pair := range pairs {
+				fresh[pair.Key] = pair.Value
+				if old, ok := seen[pair.Key]; !ok || string(old) != string(pair.Value) {
+					select {
+					case out <- discovery.Event{Type: discovery.EventPut, Key: pair.Key, Value: pair.Value}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			for key := range seen {
+				if _, ok := fresh[key]; !ok {
+					select {
+					case out <- discovery.Event{Type: discovery.EventDelete, Key: key}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			seen = fresh
+		}
+	}()
+
+	return out, nil
+}
+
+func (d *driver) Close() error {
+	return nil
+}
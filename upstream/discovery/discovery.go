@@ -0,0 +1,92 @@
+// Package discovery abstracts the service-discovery / KV backend used to
+// feed upstream.HostDB, the same way libkv abstracts etcd/consul/zookeeper
+// behind a single store.Store interface. Drivers register themselves via
+// Register (usually from an init func in the driver package) and callers
+// obtain one with New, keyed by a backend name read out of config.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// KV is a single key/value pair as returned by List.
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+// EventType identifies the kind of change a Watch delivers.
+type EventType int
+
+// Event types emitted on a Watch channel.
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// Event describes a single change observed under a watched prefix.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+}
+
+// Discovery abstracts a service-discovery / KV backend. Implementations are
+// expected to be safe for concurrent use.
+type Discovery interface {
+	// List returns every key/value pair currently stored under prefix.
+	List(prefix string) ([]KV, error)
+
+	// Watch streams Put/Delete events for keys under prefix. Implementations
+	// retry transient errors internally with backoff instead of giving up;
+	// the channel only closes when ctx is canceled, in which case callers
+	// should re-List and re-Watch to resync.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
+
+	// Close releases any resources held by the driver.
+	Close() error
+}
+
+// Factory builds a Discovery driver from its backend-specific config,
+// scoped to e.g. `discovery.<backend>` in the global config.
+type Factory func(v *viper.Viper) (Discovery, error)
+
+var (
+	mu      sync.RWMutex
+	drivers = map[string]Factory{}
+)
+
+// Register makes a driver available under name. It is meant to be called
+// from a driver package's init func. Register panics on duplicate names,
+// mirroring database/sql's driver registry.
+func Register(name string, factory Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if factory == nil {
+		panic("discovery: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("discovery: Register called twice for backend " + name)
+	}
+	drivers[name] = factory
+}
+
+// New instantiates the named backend driver with the given config.
+func New(name string, v *viper.Viper) (Discovery, error) {
+	mu.RLock()
+	factory, ok := drivers[name]
+	mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("discovery: unknown backend %q (forgot a driver import?)", name)
+	}
+	if v == nil {
+		v = viper.New()
+	}
+	return factory(v)
+}
@@ -0,0 +1,164 @@
+// Package etcdv2 is a discovery.Discovery driver backed by etcd's v2 API,
+// for deployments that haven't migrated off the old client/server protocol.
+package etcdv2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	etcdclient "github.com/coreos/etcd/client"
+	"github.com/ejoy/goscon/upstream/discovery"
+	"github.com/ejoy/goscon/upstream/internal/backoff"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	discovery.Register("etcdv2", New)
+}
+
+type driver struct {
+	keys etcdclient.KeysAPI
+}
+
+// New builds an etcd v2 driver from config scoped at `discovery.etcdv2`:
+//
+//	endpoints           []string
+//	username / password optional basic auth
+func New(v *viper.Viper) (discovery.Discovery, error) {
+	endpoints := v.GetStringSlice("endpoints")
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcdv2: discovery.etcdv2.endpoints not found in config")
+	}
+
+	cli, err := etcdclient.New(etcdclient.Config{
+		Endpoints: endpoints,
+		Username:  v.GetString("username"),
+		Password:  v.GetString("password"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &driver{keys: etcdclient.NewKeysAPI(cli)}, nil
+}
+
+func (d *driver) List(prefix string) ([]discovery.KV, error) {
+	resp, err := d.keys.Get(context.Background(), prefix, &etcdclient.GetOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var kvs []discovery.KV
+	flatten(resp.Node, &kvs)
+	return kvs, nil
+}
+
+func flatten(node *etcdclient.Node, kvs *[]discovery.KV) {
+	if node == nil {
+		return
+	}
+	if !node.Dir {
+		*kvs = append(*kvs, discovery.KV{Key: node.Key, Value: []byte(node.Value)})
+		return
+	}
+	for _, child := range node.Nodes {
+		flatten(child, kvs)
+	}
+}
+
+// Watch streams etcd v2's native Put/Delete events. A watcher that errors
+// out (expired index, connectivity blip, ...) is recreated after a backoff
+// instead of closing the channel; since restarting the watcher can miss
+// whatever changed in between, each (re)start first resyncs by diffing a
+// fresh List against seen, so the caller never loses a delete.
+func (d *driver) Watch(ctx context.Context, prefix string) (<-chan discovery.Event, error) {
+	out := make(chan discovery.Event)
+
+	go func() {
+		defer close(out)
+
+		seen := map[string][]byte{}
+		attempt := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			kvs, err := d.List(prefix)
+			if err != nil {
+				select {
+				case <-time.After(backoff.Next(attempt)):
+				case <-ctx.Done():
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+
+			fresh := map[string][]byte{}
+			for _, kv := range kvs {
+				fresh[kv.Key] = kv.Value
+				if old, ok := seen[kv.Key]; !ok || string(old) != string(kv.Value) {
+					select {
+					case out <- discovery.Event{Type: discovery.EventPut, Key: kv.Key, Value: kv.Value}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			for key := range seen {
+				if _, ok := fresh[key]; !ok {
+					select {
+					case out <- discovery.Event{Type: discovery.EventDelete, Key: key}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			seen = fresh
+
+			watcher := d.keys.Watcher(prefix, &etcdclient.WatcherOptions{Recursive: true})
+		watchLoop:
+			for {
+				resp, err := watcher.Next(ctx)
+				if err != nil {
+					select {
+					case <-time.After(backoff.Next(attempt)):
+					case <-ctx.Done():
+						return
+					}
+					attempt++
+					break watchLoop
+				}
+				attempt = 0
+
+				switch resp.Action {
+				case "set", "update", "create", "compareAndSwap":
+					seen[resp.Node.Key] = []byte(resp.Node.Value)
+					select {
+					case out <- discovery.Event{Type: discovery.EventPut, Key: resp.Node.Key, Value: []byte(resp.Node.Value)}:
+					case <-ctx.Done():
+						return
+					}
+				case "delete", "expire", "compareAndDelete":
+					delete(seen, resp.Node.Key)
+					select {
+					case out <- discovery.Event{Type: discovery.EventDelete, Key: resp.Node.Key}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (d *driver) Close() error {
+	return nil
+}
@@ -0,0 +1,249 @@
+// Package etcdv3 is a discovery.Discovery driver backed by etcd's v3 API.
+package etcdv3
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/ejoy/goscon/upstream/discovery"
+	"github.com/ejoy/goscon/upstream/internal/backoff"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	discovery.Register("etcd", New)
+}
+
+type driver struct {
+	cli *clientv3.Client
+}
+
+// New builds an etcd v3 driver from config scoped at `discovery.etcd`:
+//
+//	endpoints             []string
+//	dial_timeout          duration, default 5s
+//	username / password   basic auth, optional
+//	tls.ca/cert/key       PEM paths, optional
+//	tls.insecure_skip_verify
+func New(v *viper.Viper) (discovery.Discovery, error) {
+	endpoints := v.GetStringSlice("endpoints")
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("etcdv3: discovery.etcd.endpoints not found in config")
+	}
+
+	dialTimeout := v.GetDuration("dial_timeout")
+	if dialTimeout == 0 {
+		dialTimeout = 5 * time.Second
+	}
+
+	cfg := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: dialTimeout,
+		Username:    v.GetString("username"),
+		Password:    v.GetString("password"),
+	}
+
+	tlsCfg, err := buildTLSConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLS = tlsCfg
+
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &driver{cli: cli}, nil
+}
+
+func buildTLSConfig(v *viper.Viper) (*tls.Config, error) {
+	caFile := v.GetString("tls.ca")
+	certFile := v.GetString("tls.cert")
+	keyFile := v.GetString("tls.key")
+	insecure := v.GetBool("tls.insecure_skip_verify")
+
+	if caFile == "" && certFile == "" && keyFile == "" && !insecure {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{InsecureSkipVerify: insecure}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcdv3: read tls.ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("etcdv3: no certificates found in tls.ca %q", caFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("etcdv3: load tls.cert/tls.key: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+func (d *driver) get(ctx context.Context, prefix string) (*clientv3.GetResponse, error) {
+	return d.cli.Get(ctx, prefix, clientv3.WithPrefix())
+}
+
+func (d *driver) List(prefix string) ([]discovery.KV, error) {
+	resp, err := d.get(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make([]discovery.KV, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, discovery.KV{Key: string(kv.Key), Value: kv.Value})
+	}
+	return kvs, nil
+}
+
+// Watch streams Put/Delete events starting at the current revision. If the
+// watch channel closes or etcd reports the revision was compacted, it
+// fully resyncs: a fresh Get is diffed against the last known snapshot so
+// vanished keys surface as synthetic delete events, then watching resumes
+// from the fresh revision. Reconnect attempts back off exponentially with
+// jitter instead of retrying in a tight loop.
+func (d *driver) Watch(ctx context.Context, prefix string) (<-chan discovery.Event, error) {
+	out := make(chan discovery.Event)
+
+	// The initial snapshot is recorded without emitting events: out has no
+	// reader until it is returned, and events start at the current revision.
+	resp, err := d.get(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		snapshot[string(kv.Key)] = kv.Value
+	}
+	rev := resp.Header.Revision
+
+	go func() {
+		defer close(out)
+
+		attempt := 0
+		for {
+			var closedClean bool
+			rev, closedClean = d.watchFrom(ctx, prefix, rev, snapshot, out)
+			if ctx.Err() != nil {
+				return
+			}
+			if closedClean {
+				attempt = 0
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff.Next(attempt)):
+			}
+			attempt++
+
+			newRev, err := d.resync(ctx, prefix, snapshot, out)
+			if err != nil {
+				continue
+			}
+			rev = newRev
+		}
+	}()
+
+	return out, nil
+}
+
+// watchFrom streams events starting at rev+1 until the channel closes or
+// ctx is canceled, applying each event to snapshot so resync can diff
+// against it later. It returns the last revision seen and whether the
+// channel closed without an error (as opposed to a compaction/disconnect).
+func (d *driver) watchFrom(ctx context.Context, prefix string, rev int64, snapshot map[string][]byte, out chan<- discovery.Event) (int64, bool) {
+	wch := d.cli.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+
+	for resp := range wch {
+		if resp.Err() != nil {
+			return rev, false
+		}
+
+		for _, ev := range resp.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				snapshot[string(ev.Kv.Key)] = ev.Kv.Value
+				select {
+				case out <- discovery.Event{Type: discovery.EventPut, Key: string(ev.Kv.Key), Value: ev.Kv.Value}:
+				case <-ctx.Done():
+					return rev, false
+				}
+			case clientv3.EventTypeDelete:
+				delete(snapshot, string(ev.Kv.Key))
+				select {
+				case out <- discovery.Event{Type: discovery.EventDelete, Key: string(ev.Kv.Key)}:
+				case <-ctx.Done():
+					return rev, false
+				}
+			}
+		}
+		rev = resp.Header.Revision
+	}
+
+	return rev, true
+}
+
+// resync takes a fresh snapshot under prefix, diffs it against snapshot
+// (emitting synthetic put/delete events for anything that changed or
+// vanished), updates snapshot in place, and returns the revision to
+// resume watching from.
+func (d *driver) resync(ctx context.Context, prefix string, snapshot map[string][]byte, out chan<- discovery.Event) (int64, error) {
+	resp, err := d.get(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	fresh := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		fresh[key] = kv.Value
+		if old, ok := snapshot[key]; !ok || string(old) != string(kv.Value) {
+			select {
+			case out <- discovery.Event{Type: discovery.EventPut, Key: key, Value: kv.Value}:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+	}
+	for key := range snapshot {
+		if _, ok := fresh[key]; !ok {
+			select {
+			case out <- discovery.Event{Type: discovery.EventDelete, Key: key}:
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			}
+		}
+	}
+
+	for key := range snapshot {
+		delete(snapshot, key)
+	}
+	for key, value := range fresh {
+		snapshot[key] = value
+	}
+
+	return resp.Header.Revision, nil
+}
+
+func (d *driver) Close() error {
+	return d.cli.Close()
+}
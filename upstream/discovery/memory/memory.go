@@ -0,0 +1,112 @@
+// Package memory is an in-process discovery.Discovery driver with no
+// external dependencies, intended for tests and for embedders that manage
+// their own host list without a real KV store.
+package memory
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/ejoy/goscon/upstream/discovery"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	discovery.Register("memory", New)
+}
+
+// Driver is an in-memory discovery.Discovery. Use Put/Delete to drive it
+// directly from test code.
+type Driver struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	watchers []*watcher
+}
+
+// watcher holds a watch channel alongside a closed flag; both are only
+// ever touched with Driver.mu held, so a send can never race the close
+// that removes the watcher from Driver.watchers.
+type watcher struct {
+	ch     chan discovery.Event
+	closed bool
+}
+
+// New satisfies discovery.Factory; the memory driver takes no config.
+func New(v *viper.Viper) (discovery.Discovery, error) {
+	return NewDriver(), nil
+}
+
+// NewDriver builds an empty in-memory driver.
+func NewDriver() *Driver {
+	return &Driver{data: map[string][]byte{}}
+}
+
+// Put sets key and notifies any active watchers.
+func (d *Driver) Put(key string, value []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.data[key] = value
+	for _, w := range d.watchers {
+		if w.closed {
+			continue
+		}
+		w.ch <- discovery.Event{Type: discovery.EventPut, Key: key, Value: value}
+	}
+}
+
+// Delete removes key and notifies any active watchers.
+func (d *Driver) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.data, key)
+	for _, w := range d.watchers {
+		if w.closed {
+			continue
+		}
+		w.ch <- discovery.Event{Type: discovery.EventDelete, Key: key}
+	}
+}
+
+func (d *Driver) List(prefix string) ([]discovery.KV, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	kvs := make([]discovery.KV, 0, len(d.data))
+	for key, value := range d.data {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, discovery.KV{Key: key, Value: value})
+		}
+	}
+	return kvs, nil
+}
+
+func (d *Driver) Watch(ctx context.Context, prefix string) (<-chan discovery.Event, error) {
+	w := &watcher{ch: make(chan discovery.Event, 16)}
+
+	d.mu.Lock()
+	d.watchers = append(d.watchers, w)
+	d.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for i, ww := range d.watchers {
+			if ww == w {
+				d.watchers = append(d.watchers[:i], d.watchers[i+1:]...)
+				break
+			}
+		}
+		w.closed = true
+		close(w.ch)
+	}()
+
+	return w.ch, nil
+}
+
+func (d *Driver) Close() error {
+	return nil
+}
@@ -0,0 +1,161 @@
+// Package zookeeper is a discovery.Discovery driver backed by ZooKeeper.
+package zookeeper
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/ejoy/goscon/upstream/discovery"
+	"github.com/ejoy/goscon/upstream/internal/backoff"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	discovery.Register("zookeeper", New)
+}
+
+type driver struct {
+	conn *zk.Conn
+}
+
+// New builds a ZooKeeper driver from config scoped at `discovery.zookeeper`:
+//
+//	endpoints      []string
+//	session_timeout duration, default 10s
+func New(v *viper.Viper) (discovery.Discovery, error) {
+	endpoints := v.GetStringSlice("endpoints")
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("zookeeper: discovery.zookeeper.endpoints not found in config")
+	}
+
+	sessionTimeout := v.GetDuration("session_timeout")
+	if sessionTimeout == 0 {
+		sessionTimeout = 10 * time.Second
+	}
+
+	conn, _, err := zk.Connect(endpoints, sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &driver{conn: conn}, nil
+}
+
+func (d *driver) List(prefix string) ([]discovery.KV, error) {
+	var kvs []discovery.KV
+	if err := d.walk(prefix, &kvs); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+func (d *driver) walk(node string, kvs *[]discovery.KV) error {
+	children, _, err := d.conn.Children(node)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		return err
+	}
+
+	for _, child := range children {
+		childPath := path.Join(node, child)
+		data, stat, err := d.conn.Get(childPath)
+		if err != nil {
+			return err
+		}
+		if stat.NumChildren > 0 {
+			if err := d.walk(childPath, kvs); err != nil {
+				return err
+			}
+			continue
+		}
+		*kvs = append(*kvs, discovery.KV{Key: childPath, Value: data})
+	}
+	return nil
+}
+
+// Watch polls prefix's children using ZooKeeper's one-shot watches,
+// re-arming after each fire since zk has no native recursive/streaming
+// watch primitive. A failed List or ChildrenW backs off and retries instead
+// of giving up, so a connectivity blip can't permanently stop deletes from
+// reaching the caller; seen is kept across retries so the next successful
+// poll still diffs against the last known-good snapshot.
+func (d *driver) Watch(ctx context.Context, prefix string) (<-chan discovery.Event, error) {
+	out := make(chan discovery.Event)
+
+	go func() {
+		defer close(out)
+
+		seen := map[string][]byte{}
+		attempt := 0
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			kvs, err := d.List(prefix)
+			if err != nil {
+				select {
+				case <-time.After(backoff.Next(attempt)):
+				case <-ctx.Done():
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+
+			fresh := map[string][]byte{}
+			for _, kv := range kvs {
+				fresh[kv.Key] = kv.Value
+				if old, ok := seen[kv.Key]; !ok || string(old) != string(kv.Value) {
+					select {
+					case out <- discovery.Event{Type: discovery.EventPut, Key: kv.Key, Value: kv.Value}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			for key := range seen {
+				if _, ok := fresh[key]; !ok {
+					select {
+					case out <- discovery.Event{Type: discovery.EventDelete, Key: key}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			seen = fresh
+
+			_, _, events, err := d.conn.ChildrenW(prefix)
+			if err != nil {
+				select {
+				case <-time.After(backoff.Next(attempt)):
+				case <-ctx.Done():
+					return
+				}
+				attempt++
+				continue
+			}
+			attempt = 0
+			select {
+			case <-events:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (d *driver) Close() error {
+	d.conn.Close()
+	return nil
+}
@@ -0,0 +1,102 @@
+package upstream
+
+import (
+	"testing"
+)
+
+func mustParseHost(t *testing.T, key, value string) *HostRecord {
+	t.Helper()
+	rec, err := parseHost([]byte(key), []byte(value))
+	if err != nil {
+		t.Fatalf("parseHost(%q, %q) failed: %v", key, value, err)
+	}
+	return rec
+}
+
+func newTestDB(t *testing.T, entries ...struct{ key, value string }) *HostDB {
+	db := &HostDB{tables: map[string]*HostTable{}}
+	for _, e := range entries {
+		db.put(mustParseHost(t, e.key, e.value))
+	}
+	return db
+}
+
+// TestHostDBQuery_ConstraintPrefersHighestMatching covers the chunk0-2
+// behavior: a table whose Constraint is satisfied by the client's semver
+// wins over the nearest-lower-version fallback, and among several
+// satisfying constraints the highest-numVer table is preferred.
+func TestHostDBQuery_ConstraintPrefersHighestMatching(t *testing.T) {
+	db := newTestDB(t,
+		struct{ key, value string }{"/hosts/a", `{"host":"10.0.0.1","port":1,"weight":1,"version":"1.2.0","constraint":"^1.2.0"}`},
+		struct{ key, value string }{"/hosts/b", `{"host":"10.0.0.2","port":2,"weight":1,"version":"1.3.0","constraint":"~1.3.0"}`},
+	)
+
+	// 1.3.1 satisfies both ^1.2.0 and ~1.3.0; the higher-numVer table
+	// (1.3.0) should win.
+	rec := db.query("1.3.1", "")
+	if rec == nil || rec.addr != "10.0.0.2:2" {
+		t.Fatalf("expected host from the ~1.3.0 table, got %+v", rec)
+	}
+
+	// 1.2.5 only satisfies ^1.2.0 (outside ~1.3.0's range).
+	rec = db.query("1.2.5", "")
+	if rec == nil || rec.addr != "10.0.0.1:1" {
+		t.Fatalf("expected host from the ^1.2.0 table, got %+v", rec)
+	}
+}
+
+// TestHostDBQuery_CaretConstraint covers the "^" (caret) range semantics:
+// compatible-with, i.e. no breaking change per the leading non-zero
+// component. A client version the constraint rejects still falls back to
+// the nearest lower-version table, per pick()'s documented fallback, so
+// the rejection case here uses a version below every table instead.
+func TestHostDBQuery_CaretConstraint(t *testing.T) {
+	db := newTestDB(t,
+		struct{ key, value string }{"/hosts/a", `{"host":"10.0.0.1","port":1,"weight":1,"version":"1.0.0","constraint":"^1.0.0"}`},
+	)
+
+	if rec := db.query("1.9.9", ""); rec == nil {
+		t.Fatalf("expected ^1.0.0 to match 1.9.9")
+	}
+	if rec := db.query("0.9.0", ""); rec != nil {
+		t.Fatalf("expected 0.9.0 to miss (below ^1.0.0, no lower table), got %+v", rec)
+	}
+}
+
+// TestHostDBQuery_TildeConstraint covers the "~" (tilde) range semantics:
+// allows patch-level changes only. As above, the rejection case uses a
+// version below every table so the nearest-lower-version fallback can't
+// mask it.
+func TestHostDBQuery_TildeConstraint(t *testing.T) {
+	db := newTestDB(t,
+		struct{ key, value string }{"/hosts/a", `{"host":"10.0.0.1","port":1,"weight":1,"version":"1.2.0","constraint":"~1.2.0"}`},
+	)
+
+	if rec := db.query("1.2.9", ""); rec == nil {
+		t.Fatalf("expected ~1.2.0 to match 1.2.9")
+	}
+	if rec := db.query("1.1.0", ""); rec != nil {
+		t.Fatalf("expected 1.1.0 to miss (below ~1.2.0, no lower table), got %+v", rec)
+	}
+}
+
+// TestHostDBQuery_PrereleaseOrdering covers semver pre-release precedence:
+// a pre-release client version is excluded from a constraint unless the
+// constraint itself references a pre-release at the same base version, per
+// the semver spec's pre-release comparison rules.
+func TestHostDBQuery_PrereleaseOrdering(t *testing.T) {
+	db := newTestDB(t,
+		struct{ key, value string }{"/hosts/a", `{"host":"10.0.0.1","port":1,"weight":1,"version":"1.2.0","constraint":">=1.2.0"}`},
+	)
+
+	// 1.2.0-beta is ordered before 1.2.0, so it doesn't satisfy >=1.2.0,
+	// and toNumVer's pre-release stripping leaves no lower table either.
+	if rec := db.query("1.2.0-beta", ""); rec != nil {
+		t.Fatalf("expected 1.2.0-beta to fail >=1.2.0, got %+v", rec)
+	}
+
+	// A fully-released version past the constraint succeeds.
+	if rec := db.query("1.2.1", ""); rec == nil {
+		t.Fatalf("expected 1.2.1 to satisfy >=1.2.0")
+	}
+}
@@ -0,0 +1,157 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/xjdrew/glog"
+)
+
+// ProbeFunc reports whether addr is reachable. The zero value of
+// HealthCheckOptions uses tcpProbe, a plain connect-and-close.
+type ProbeFunc func(addr string, timeout time.Duration) error
+
+func tcpProbe(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// HealthEventHook is notified whenever a record's health flips, so
+// operators can log or alert without depending on Prometheus.
+type HealthEventHook func(rec *HostRecord, healthy bool)
+
+// HealthCheckOptions configures StartHealthCheck; a zero value falls back
+// to tcpProbe with sane defaults.
+type HealthCheckOptions struct {
+	Probe            ProbeFunc
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int
+	SuccessThreshold int
+	Hook             HealthEventHook
+}
+
+func (o *HealthCheckOptions) withDefaults() HealthCheckOptions {
+	out := *o
+	if out.Probe == nil {
+		out.Probe = tcpProbe
+	}
+	if out.Interval <= 0 {
+		out.Interval = 5 * time.Second
+	}
+	if out.Timeout <= 0 {
+		out.Timeout = 2 * time.Second
+	}
+	if out.FailureThreshold <= 0 {
+		out.FailureThreshold = 3
+	}
+	if out.SuccessThreshold <= 0 {
+		out.SuccessThreshold = 2
+	}
+	return out
+}
+
+// HealthCheckOptionsFromViper reads `health.*` out of the global config:
+// interval, timeout, failure_threshold, success_threshold (all optional).
+func HealthCheckOptionsFromViper() HealthCheckOptions {
+	return HealthCheckOptions{
+		Interval:         viper.GetDuration("health.interval"),
+		Timeout:          viper.GetDuration("health.timeout"),
+		FailureThreshold: viper.GetInt("health.failure_threshold"),
+		SuccessThreshold: viper.GetInt("health.success_threshold"),
+	}
+}
+
+// HealthChecker periodically probes every record known to _DB and flips
+// HostRecord.unhealthy after FailureThreshold consecutive failed probes;
+// BalancePolicy.Pick skips unhealthy records but they stay in HostTable so
+// SuccessThreshold consecutive passing probes re-admit them.
+type HealthChecker struct {
+	opts HealthCheckOptions
+	stop chan struct{}
+
+	mu     sync.Mutex
+	counts map[string]int // rec.key -> consecutive probe results; >0 successes, <0 failures
+}
+
+// StartHealthCheck launches the periodic probe loop in a goroutine and
+// returns the checker so callers can Stop it later.
+func StartHealthCheck(opts HealthCheckOptions) *HealthChecker {
+	h := &HealthChecker{
+		opts:   opts.withDefaults(),
+		stop:   make(chan struct{}),
+		counts: map[string]int{},
+	}
+
+	go h.run()
+	return h
+}
+
+// Stop halts the probe loop. It does not reset any record's health state.
+func (h *HealthChecker) Stop() {
+	close(h.stop)
+}
+
+func (h *HealthChecker) run() {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.probeAll()
+		}
+	}
+}
+
+func (h *HealthChecker) probeAll() {
+	for _, rec := range _DB.allRecords() {
+		h.probeOne(rec)
+	}
+}
+
+func (h *HealthChecker) probeOne(rec *HostRecord) {
+	err := h.opts.Probe(rec.addr, h.opts.Timeout)
+
+	h.mu.Lock()
+	count := h.counts[rec.key]
+	if err != nil {
+		if count > 0 {
+			count = 0
+		}
+		count--
+	} else {
+		if count < 0 {
+			count = 0
+		}
+		count++
+	}
+	h.counts[rec.key] = count
+	h.mu.Unlock()
+
+	wasUnhealthy := atomic.LoadInt32(&rec.unhealthy) != 0
+	switch {
+	case err != nil && count <= -h.opts.FailureThreshold && !wasUnhealthy:
+		atomic.StoreInt32(&rec.unhealthy, 1)
+		glog.Errorf("upstream: host %v marked unhealthy after %d consecutive probe failures: %v", rec.addr, -count, err)
+		glog.Flush()
+		if h.opts.Hook != nil {
+			h.opts.Hook(rec, false)
+		}
+	case err == nil && count >= h.opts.SuccessThreshold && wasUnhealthy:
+		atomic.StoreInt32(&rec.unhealthy, 0)
+		glog.Infof("upstream: host %v re-admitted after %d consecutive successful probes", rec.addr, count)
+		glog.Flush()
+		if h.opts.Hook != nil {
+			h.opts.Hook(rec, true)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Package backoff is the shared exponential-backoff-with-jitter helper
+// used by the etcdv3 discovery driver and the registry package, so a herd
+// of reconnecting watchers/registrations doesn't hammer etcd in lockstep.
+package backoff
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	Base = 500 * time.Millisecond
+	Max  = 30 * time.Second
+)
+
+// Next returns an exponentially growing delay for attempt (capped at Max)
+// with up to 50% jitter.
+func Next(attempt int) time.Duration {
+	d := Base << uint(attempt)
+	if d <= 0 || d > Max {
+		d = Max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2+1)))
+}
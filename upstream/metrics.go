@@ -0,0 +1,86 @@
+package upstream
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricHosts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goscon_upstream_hosts",
+		Help: "Number of registered upstream hosts, by client version.",
+	}, []string{"version"})
+
+	metricQueryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_upstream_query_total",
+		Help: "HostDB.query outcomes, by client version and result (hit/fallback/miss).",
+	}, []string{"version", "result"})
+
+	metricDialSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goscon_upstream_dial_seconds",
+		Help:    "Latency of dialing an upstream backend in NewConn.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"addr"})
+
+	metricHandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_upstream_handshake_failures_total",
+		Help: "scp handshake failures after a successful TCP dial, by backend address.",
+	}, []string{"addr"})
+
+	metricEtcdEventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goscon_upstream_etcd_events_total",
+		Help: "Discovery watch events observed, by type (put/delete).",
+	}, []string{"type"})
+)
+
+// RegisterMetrics registers every upstream collector on reg; pass nil to
+// use prometheus.DefaultRegisterer. Call once at startup, before the main
+// binary starts serving /metrics.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	for _, c := range []prometheus.Collector{
+		metricHosts,
+		metricQueryTotal,
+		metricDialSeconds,
+		metricHandshakeFailures,
+		metricEtcdEventsTotal,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventHook lets embedders observe the same events the Prometheus metrics
+// above are derived from, without taking a dependency on Prometheus.
+type EventHook interface {
+	OnHostUp(rec *HostRecord)
+	OnHostDown(rec *HostRecord)
+	OnQuery(version, result string)
+	OnDial(addr string, elapsed time.Duration, err error)
+}
+
+// eventHookHolder boxes the current EventHook so SetEventHook can publish a
+// new one atomically; readers on other goroutines (query/put/delete/
+// watchDiscovery/NewConn) would otherwise race with a concurrent Set.
+var eventHookHolder atomic.Value // EventHook
+
+// SetEventHook installs hook as the package-wide EventHook; pass nil to
+// disable. Only one hook can be active at a time.
+func SetEventHook(hook EventHook) {
+	eventHookHolder.Store(&hook)
+}
+
+// currentEventHook returns the active EventHook, or nil if none is set.
+func currentEventHook() EventHook {
+	v, _ := eventHookHolder.Load().(*EventHook)
+	if v == nil {
+		return nil
+	}
+	return *v
+}
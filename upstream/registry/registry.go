@@ -0,0 +1,157 @@
+// Package registry is the producer-side counterpart to upstream/discovery:
+// backend servers import it to publish themselves into etcd under a lease,
+// so a crash lets the lease expire and the key disappears on its own
+// instead of lingering until someone deletes it by hand.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/ejoy/goscon/upstream/internal/backoff"
+)
+
+// HostRecord is the subset of upstream.HostRecord a backend needs to fill
+// in to announce itself; it's marshaled as-is into the registered key.
+type HostRecord struct {
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Weight     int    `json:"weight"`
+	Version    string `json:"version"`
+	Constraint string `json:"constraint,omitempty"`
+}
+
+// RegisteredHost is a live lease-backed registration. Call Close when the
+// backend is shutting down cleanly; otherwise the lease simply expires.
+type RegisteredHost struct {
+	cli *clientv3.Client
+	key string
+	rec HostRecord
+	ttl time.Duration
+
+	leaseID clientv3.LeaseID
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Register grants an etcd lease of ttl, Puts rec's JSON under
+// prefix/rec.Name with that lease attached, and starts a goroutine that
+// keeps the lease alive until Close is called or re-registration gives up
+// permanently (see Done).
+func Register(ctx context.Context, cli *clientv3.Client, prefix string, rec HostRecord, ttl time.Duration) (*RegisteredHost, error) {
+	rh := &RegisteredHost{
+		cli:    cli,
+		key:    path.Join(prefix, rec.Name),
+		rec:    rec,
+		ttl:    ttl,
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if err := rh.grantAndPut(ctx); err != nil {
+		return nil, err
+	}
+
+	go rh.keepAlive(ctx)
+	return rh, nil
+}
+
+func (rh *RegisteredHost) grantAndPut(ctx context.Context) error {
+	ttlSeconds := int64(rh.ttl / time.Second)
+	if ttlSeconds < 1 {
+		ttlSeconds = 1
+	}
+
+	lease, err := rh.cli.Grant(ctx, ttlSeconds)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rh.rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := rh.cli.Put(ctx, rh.key, string(data), clientv3.WithLease(lease.ID)); err != nil {
+		return err
+	}
+
+	rh.leaseID = lease.ID
+	return nil
+}
+
+// keepAlive streams KeepAlive responses for the current lease. If the
+// keepalive channel closes (lease lost, connection dropped, etc.) it tries
+// to re-grant a fresh lease and re-Put the value, mirroring how etcd's own
+// client handles a dropped keepalive stream, instead of giving up. Done()
+// only closes when re-registration is abandoned because ctx was canceled
+// or Close was called.
+func (rh *RegisteredHost) keepAlive(ctx context.Context) {
+	defer close(rh.done)
+
+	attempt := 0
+	for {
+		ch, err := rh.cli.KeepAlive(ctx, rh.leaseID)
+		if err == nil {
+			if rh.drain(ch) {
+				return // Close() called
+			}
+			attempt = 0
+		}
+
+		select {
+		case <-rh.closed:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff.Next(attempt)):
+		}
+		attempt++
+
+		if err := rh.grantAndPut(ctx); err != nil {
+			continue
+		}
+	}
+}
+
+// drain consumes keepalive responses until the channel closes (lease
+// lost or connection dropped) or Close is called. It returns true only
+// when Close triggered the return.
+func (rh *RegisteredHost) drain(ch <-chan *clientv3.LeaseKeepAliveResponse) bool {
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return false
+			}
+		case <-rh.closed:
+			return true
+		}
+	}
+}
+
+// Close revokes the lease (deleting the key immediately) and stops the
+// keepalive goroutine.
+func (rh *RegisteredHost) Close() error {
+	rh.closeOnce.Do(func() { close(rh.closed) })
+	<-rh.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := rh.cli.Revoke(ctx, rh.leaseID)
+	return err
+}
+
+// Done returns a channel that closes once this registration is
+// permanently gone: either Close was called, or the background goroutine
+// gave up re-registering because ctx was canceled.
+func (rh *RegisteredHost) Done() <-chan struct{} {
+	return rh.done
+}
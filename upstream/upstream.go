@@ -6,6 +6,7 @@ import (
 	"net"
 	"regexp"
 	"sync/atomic"
+	"time"
 
 	"github.com/ejoy/goscon/scp"
 	"github.com/xjdrew/glog"
@@ -237,6 +238,7 @@ func upgradeConn(network string, localConn net.Conn, remoteConn *scp.Conn) (conn
 		err = scon.Handshake()
 		if err != nil {
 			glog.Errorf("scp handshake failed: client=%s, err=%s", scon.RemoteAddr().String(), err.Error())
+			metricHandshakeFailures.WithLabelValues(localConn.RemoteAddr().String()).Inc()
 			return
 		}
 		conn = scon
@@ -277,16 +279,29 @@ func (u *upstreams) NewConn(remoteConn *scp.Conn) (conn net.Conn, err error) {
 	// 2023.3.23 从discovery.go实现的接口 获取一个host:port
 	//      3.31 与特定版本逻辑服解耦 提升通用性
 	//------------------------------------------------------------
-	addr := QueryHost(remoteConn.Version)
-	if addr == "" {
+	// 使用客户端地址做一致性哈希的 sessionKey, 保证同一客户端重连落到同一后端
+	sessionKey := remoteConn.RemoteAddr().String()
+	if host, _, splitErr := net.SplitHostPort(sessionKey); splitErr == nil {
+		sessionKey = host
+	}
+	rec := QueryHost(remoteConn.Version, sessionKey)
+	if rec == nil {
 		err = ErrNoHost
 		glog.Error("get host failed, cause none host is online")
 		return
 	}
+	addr := rec.Addr()
 
+	dialStart := time.Now()
 	tcpConn, err := net.Dial("tcp", addr)
+	dialElapsed := time.Since(dialStart)
+	metricDialSeconds.WithLabelValues(addr).Observe(dialElapsed.Seconds())
+	if hook := currentEventHook(); hook != nil {
+		hook.OnDial(addr, dialElapsed, err)
+	}
 	if err != nil {
 		glog.Errorf("connect to <%v> failed: %v", addr, err)
+		currentBreaker().RecordFailure(rec)
 		return
 	}
 
@@ -294,8 +309,10 @@ func (u *upstreams) NewConn(remoteConn *scp.Conn) (conn net.Conn, err error) {
 	conn, err = upgradeConn(option.Net, tcpConn, remoteConn)
 	if err != nil {
 		conn.Close()
+		currentBreaker().RecordFailure(rec)
 		return
 	}
+	currentBreaker().RecordSuccess(rec)
 
 	err = OnAfterConnected(conn, remoteConn)
 	return